@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/thunderdb/ThunderDB/proto"
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// DefaultLookupFanout is how many block producers LookupNode queries in
+// parallel (alpha, in Kademlia terms) when no override is given.
+const DefaultLookupFanout = 3
+
+// ErrNoAvailableBP is returned by LookupNode when route.GetBPs() is empty.
+var ErrNoAvailableBP = errors.New("route: no available BP")
+
+// getBPs is GetBPs by default; tests override it to exercise LookupNode
+// against a fixed, deterministic BP set instead of the real one.
+var getBPs = GetBPs
+
+// NodeCaller is the subset of rpc.Caller LookupNode needs to fan calls out
+// to block producers. It is declared here rather than imported from the rpc
+// package to avoid a cycle: rpc already depends on route for GetBPs and the
+// address cache.
+type NodeCaller interface {
+	CallNodeWithContext(ctx context.Context, node proto.NodeID, method string, args, reply interface{}) error
+}
+
+// bpStat is a simple exponentially weighted moving average of a BP's recent
+// DHT.FindNode latency, used to bias future lookups towards faster/healthier
+// BPs. A failed call is recorded as a large latency penalty rather than
+// dropped, so a BP that is down falls to the back of the line.
+type bpStat struct {
+	ewmaMillis float64
+}
+
+const (
+	bpStatDecay              = 0.3
+	bpStatErrorPenaltyMillis = 2000
+)
+
+var (
+	bpStatsMu sync.Mutex
+	bpStats   = make(map[proto.NodeID]*bpStat)
+)
+
+func recordBPLatency(bp proto.NodeID, d time.Duration, err error) {
+	millis := float64(d / time.Millisecond)
+	if err != nil {
+		millis = bpStatErrorPenaltyMillis
+	}
+
+	bpStatsMu.Lock()
+	defer bpStatsMu.Unlock()
+	if s, ok := bpStats[bp]; ok {
+		s.ewmaMillis = s.ewmaMillis*(1-bpStatDecay) + millis*bpStatDecay
+		return
+	}
+	bpStats[bp] = &bpStat{ewmaMillis: millis}
+}
+
+// orderBPsBySpeed shuffles bps with rnd and then stably sorts the ones with
+// a recorded EWMA to the front, fastest first; BPs with no history keep
+// their random relative order.
+func orderBPsBySpeed(bps []proto.NodeID, rnd *rand.Rand) []proto.NodeID {
+	ordered := make([]proto.NodeID, len(bps))
+	copy(ordered, bps)
+	rnd.Shuffle(len(ordered), func(i, j int) {
+		ordered[i], ordered[j] = ordered[j], ordered[i]
+	})
+
+	bpStatsMu.Lock()
+	defer bpStatsMu.Unlock()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		si, oki := bpStats[ordered[i]]
+		sj, okj := bpStats[ordered[j]]
+		if oki && okj {
+			return si.ewmaMillis < sj.ewmaMillis
+		}
+		return oki && !okj
+	})
+	return ordered
+}
+
+// LookupNode resolves id by fanning DHT.FindNode out to up to alpha block
+// producers at once through caller, returning the first successful
+// response and cancelling the rest. alpha <= 0 uses DefaultLookupFanout.
+func LookupNode(ctx context.Context, id *proto.RawNodeID, caller NodeCaller, alpha int) (node *proto.Node, err error) {
+	if alpha <= 0 {
+		alpha = DefaultLookupFanout
+	}
+
+	bps := getBPs()
+	if len(bps) == 0 {
+		err = ErrNoAvailableBP
+		return
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ordered := orderBPsBySpeed(bps, rnd)
+	if alpha < len(ordered) {
+		ordered = ordered[:alpha]
+	}
+
+	lookupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type findResult struct {
+		node *proto.Node
+		err  error
+	}
+	results := make(chan findResult, len(ordered))
+
+	for _, bp := range ordered {
+		bp := bp
+		go func() {
+			req := &proto.FindNodeReq{NodeID: proto.NodeID(id.String())}
+			resp := new(proto.FindNodeResp)
+
+			start := time.Now()
+			callErr := caller.CallNodeWithContext(lookupCtx, bp, "DHT.FindNode", req, resp)
+			recordBPLatency(bp, time.Since(start), callErr)
+
+			if callErr != nil {
+				results <- findResult{err: callErr}
+				return
+			}
+			results <- findResult{node: resp.Node}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(ordered); i++ {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			log.WithField("node", id).WithError(r.err).Error("DHT.FindNode lookup failed")
+			continue
+		}
+		if r.node != nil {
+			node = r.node
+			return
+		}
+	}
+
+	if lastErr != nil {
+		err = lastErr
+		return
+	}
+	err = ErrUnknownNodeID
+	return
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/thunderdb/ThunderDB/proto"
+)
+
+// fakeCaller is a NodeCaller that answers DHT.FindNode after a configurable
+// per-node delay (honoring ctx cancellation) instead of making a real RPC,
+// so LookupNode's fan-out/latency-bias/cancellation behavior can be driven
+// deterministically.
+type fakeCaller struct {
+	delays map[proto.NodeID]time.Duration
+	fail   map[proto.NodeID]bool
+
+	mu       sync.Mutex
+	canceled map[proto.NodeID]bool
+}
+
+func (c *fakeCaller) CallNodeWithContext(ctx context.Context, node proto.NodeID, method string, args, reply interface{}) error {
+	select {
+	case <-time.After(c.delays[node]):
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.canceled[node] = true
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+
+	if c.fail[node] {
+		return errTestBPFailed
+	}
+
+	resp := reply.(*proto.FindNodeResp)
+	resp.Node = &proto.Node{Addr: string(node)}
+	return nil
+}
+
+func (c *fakeCaller) wasCanceled(node proto.NodeID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.canceled[node]
+}
+
+var errTestBPFailed = &testError{"simulated BP failure"}
+
+type testError struct{ msg string }
+
+func (e *testError) Error() string { return e.msg }
+
+// withFakeBPs overrides getBPs and clears bpStats for the duration of a
+// test, so latency bias learned by one test can't leak into another.
+func withFakeBPs(t *testing.T, bps []proto.NodeID) {
+	t.Helper()
+	prevGetBPs := getBPs
+	getBPs = func() []proto.NodeID { return bps }
+
+	bpStatsMu.Lock()
+	prevStats := bpStats
+	bpStats = make(map[proto.NodeID]*bpStat)
+	bpStatsMu.Unlock()
+
+	t.Cleanup(func() {
+		getBPs = prevGetBPs
+		bpStatsMu.Lock()
+		bpStats = prevStats
+		bpStatsMu.Unlock()
+	})
+}
+
+func TestLookupNode_PicksFastestBP(t *testing.T) {
+	const slow, medium, fast = proto.NodeID("bp-slow"), proto.NodeID("bp-medium"), proto.NodeID("bp-fast")
+	bps := []proto.NodeID{slow, medium, fast}
+	withFakeBPs(t, bps)
+
+	caller := &fakeCaller{
+		delays: map[proto.NodeID]time.Duration{
+			slow:   50 * time.Millisecond,
+			medium: 20 * time.Millisecond,
+			fast:   1 * time.Millisecond,
+		},
+		canceled: make(map[proto.NodeID]bool),
+	}
+
+	node, err := LookupNode(context.Background(), &proto.RawNodeID{}, caller, len(bps))
+	if err != nil {
+		t.Fatalf("LookupNode returned error: %s", err)
+	}
+	if node == nil || node.Addr != string(fast) {
+		t.Fatalf("expected fastest BP %q to win, got %+v", fast, node)
+	}
+
+	// Give the slower goroutines a moment to observe the cancellation that
+	// LookupNode issues once the fastest response wins.
+	deadline := time.After(200 * time.Millisecond)
+	for !caller.wasCanceled(slow) || !caller.wasCanceled(medium) {
+		select {
+		case <-deadline:
+			t.Fatalf("expected slower BPs to be canceled once %q won, slow=%v medium=%v",
+				fast, caller.wasCanceled(slow), caller.wasCanceled(medium))
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestLookupNode_SkipsFailingBP(t *testing.T) {
+	const bad, good = proto.NodeID("bp-bad"), proto.NodeID("bp-good")
+	bps := []proto.NodeID{bad, good}
+	withFakeBPs(t, bps)
+
+	caller := &fakeCaller{
+		delays: map[proto.NodeID]time.Duration{
+			bad:  time.Millisecond,
+			good: 10 * time.Millisecond,
+		},
+		fail:     map[proto.NodeID]bool{bad: true},
+		canceled: make(map[proto.NodeID]bool),
+	}
+
+	node, err := LookupNode(context.Background(), &proto.RawNodeID{}, caller, len(bps))
+	if err != nil {
+		t.Fatalf("LookupNode returned error: %s", err)
+	}
+	if node == nil || node.Addr != string(good) {
+		t.Fatalf("expected the surviving BP %q to win over the failing one, got %+v", good, node)
+	}
+}
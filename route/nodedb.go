@@ -0,0 +1,309 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gitlab.com/thunderdb/ThunderDB/proto"
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// nodeDBSchemaVersion is bumped whenever the on-disk record layout changes in
+// an incompatible way. It is stored as the first byte of every key so that
+// opening an older/newer store wipes it instead of decoding garbage.
+const nodeDBSchemaVersion byte = 1
+
+const (
+	// DefaultNodeDBCleanupCycle is how often the background janitor sweeps
+	// expired entries when no cycle is configured.
+	DefaultNodeDBCleanupCycle = time.Hour
+	// DefaultNodeDBExpiration is how long an entry may go unseen before the
+	// janitor drops it when no expiration is configured.
+	DefaultNodeDBExpiration = 24 * time.Hour
+)
+
+var nodeDBBucketName = []byte("nodes")
+
+// NodeInfo is the persisted record for a single discovered node.
+type NodeInfo struct {
+	Node            proto.Node
+	LastSeen        time.Time
+	LastPingSuccess time.Time
+	RTT             time.Duration
+}
+
+// NodeDB is a persistent, schema-versioned store of discovered nodes. It lets
+// GetNodeAddr/GetNodeInfo serve cold-start lookups from disk instead of
+// re-learning peers from the block producers on every restart.
+type NodeDB struct {
+	db         *bolt.DB
+	cycle      time.Duration
+	expiration time.Duration
+	selfID     proto.RawNodeID
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewNodeDB opens (or creates) the node database at path. cycle and
+// expiration default to DefaultNodeDBCleanupCycle/DefaultNodeDBExpiration
+// when zero. selfID is never swept by the cleanup goroutine.
+func NewNodeDB(path string, selfID proto.RawNodeID, cycle, expiration time.Duration) (db *NodeDB, err error) {
+	if cycle <= 0 {
+		cycle = DefaultNodeDBCleanupCycle
+	}
+	if expiration <= 0 {
+		expiration = DefaultNodeDBExpiration
+	}
+
+	logger := log.WithField("path", path)
+
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		logger.WithError(err).Error("open node db failed")
+		return
+	}
+
+	err = bdb.Update(func(tx *bolt.Tx) (err error) {
+		bucket := tx.Bucket(nodeDBBucketName)
+		if bucket != nil {
+			// peek at an arbitrary key to detect a stale schema
+			c := bucket.Cursor()
+			if k, _ := c.First(); k != nil && k[0] != nodeDBSchemaVersion {
+				logger.WithField("schema_version", k[0]).Warn("node db has incompatible schema version, wiping")
+				if err = tx.DeleteBucket(nodeDBBucketName); err != nil {
+					return
+				}
+				bucket = nil
+			}
+		}
+		if bucket == nil {
+			_, err = tx.CreateBucket(nodeDBBucketName)
+		}
+		return
+	})
+	if err != nil {
+		bdb.Close()
+		logger.WithError(err).Error("init node db failed")
+		return
+	}
+
+	db = &NodeDB{
+		db:         bdb,
+		cycle:      cycle,
+		expiration: expiration,
+		selfID:     selfID,
+		stopCh:     make(chan struct{}),
+	}
+	db.wg.Add(1)
+	go db.cleanupLoop()
+
+	return
+}
+
+func nodeDBKey(id *proto.RawNodeID) []byte {
+	key := make([]byte, 0, len(id)+1)
+	key = append(key, nodeDBSchemaVersion)
+	key = append(key, id[:]...)
+	return key
+}
+
+// Get returns the persisted info for id, or nil if it is not known.
+func (db *NodeDB) Get(id *proto.RawNodeID) (info *NodeInfo, err error) {
+	err = db.db.View(func(tx *bolt.Tx) (err error) {
+		v := tx.Bucket(nodeDBBucketName).Get(nodeDBKey(id))
+		if v == nil {
+			return
+		}
+		info = new(NodeInfo)
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(info)
+	})
+	if err != nil {
+		log.WithField("node", id).WithError(err).Error("get node from db failed")
+	}
+	return
+}
+
+// Set persists info for id, overwriting any existing record.
+func (db *NodeDB) Set(id *proto.RawNodeID, info *NodeInfo) (err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(info); err != nil {
+		log.WithField("node", id).WithError(err).Error("encode node failed")
+		return
+	}
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodeDBBucketName).Put(nodeDBKey(id), buf.Bytes())
+	})
+	if err != nil {
+		log.WithField("node", id).WithError(err).Error("set node in db failed")
+	}
+	return
+}
+
+// mutate runs the full get-mutate-put cycle for id inside a single bolt
+// transaction, so a concurrent UpdateLastSeen/UpdatePingSuccess for the same
+// node can't interleave a read from one with a write from the other and
+// silently clobber whichever field it didn't touch.
+func (db *NodeDB) mutate(id *proto.RawNodeID, fn func(info *NodeInfo)) (err error) {
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nodeDBBucketName)
+		key := nodeDBKey(id)
+
+		info := new(NodeInfo)
+		if v := bucket.Get(key); v != nil {
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(info); err != nil {
+				return err
+			}
+		}
+		fn(info)
+
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(info); err != nil {
+			return err
+		}
+		return bucket.Put(key, buf.Bytes())
+	})
+	if err != nil {
+		log.WithField("node", id).WithError(err).Error("update node in db failed")
+	}
+	return
+}
+
+// UpdateLastSeen records that id was just observed (e.g. via a successful
+// CallNode), creating the entry if it did not already exist.
+func (db *NodeDB) UpdateLastSeen(id *proto.RawNodeID, node *proto.Node) (err error) {
+	return db.mutate(id, func(info *NodeInfo) {
+		if node != nil {
+			info.Node = *node
+		}
+		info.LastSeen = time.Now()
+	})
+}
+
+// UpdatePingSuccess records a successful PingBP round trip and its RTT.
+func (db *NodeDB) UpdatePingSuccess(id *proto.RawNodeID, rtt time.Duration) (err error) {
+	return db.mutate(id, func(info *NodeInfo) {
+		info.LastPingSuccess = time.Now()
+		info.RTT = rtt
+	})
+}
+
+// Range calls fn for every persisted node. Iteration stops early if fn
+// returns false.
+func (db *NodeDB) Range(fn func(id proto.RawNodeID, info *NodeInfo) bool) (err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodeDBBucketName).ForEach(func(k, v []byte) error {
+			if len(k) < 1+len(proto.RawNodeID{}) || k[0] != nodeDBSchemaVersion {
+				return nil
+			}
+			var id proto.RawNodeID
+			copy(id[:], k[1:])
+			info := new(NodeInfo)
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(info); err != nil {
+				return err
+			}
+			if !fn(id, info) {
+				return errStopRange
+			}
+			return nil
+		})
+	})
+	if err == errStopRange {
+		err = nil
+	}
+	return
+}
+
+func (db *NodeDB) cleanupLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.cycle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopCh:
+			return
+		case <-ticker.C:
+			db.cleanupExpired()
+		}
+	}
+}
+
+func (db *NodeDB) cleanupExpired() {
+	deadline := time.Now().Add(-db.expiration)
+	var expired [][]byte
+
+	err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodeDBBucketName).ForEach(func(k, v []byte) error {
+			var id proto.RawNodeID
+			copy(id[:], k[1:])
+			if id == db.selfID {
+				return nil
+			}
+			info := new(NodeInfo)
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(info); err != nil {
+				return nil
+			}
+			if info.LastSeen.Before(deadline) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.WithError(err).Error("scan node db for expired entries failed")
+		return
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(nodeDBBucketName)
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("delete expired node db entries failed")
+		return
+	}
+	log.WithField("count", len(expired)).Info("node db cleanup dropped expired entries")
+}
+
+// Close stops the cleanup goroutine and closes the underlying store.
+func (db *NodeDB) Close() (err error) {
+	close(db.stopCh)
+	db.wg.Wait()
+	return db.db.Close()
+}
+
+// errStopRange is a sentinel used to break out of a bolt ForEach early.
+var errStopRange = &rangeStopError{}
+
+type rangeStopError struct{}
+
+func (*rangeStopError) Error() string { return "range stopped" }
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/thunderdb/ThunderDB/proto"
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// nodeDB holds the process-wide NodeDB instance set up by InitNodeDB. It is
+// nil until InitNodeDB succeeds; while it is nil the DB-backed helpers below
+// are no-ops rather than failing callers that predate persistence.
+var nodeDB atomic.Value // *NodeDB
+
+// InitNodeDB opens the persistent node database at path and seeds the
+// in-memory address cache from it, so cold starts do not have to contact a
+// block producer before resolving any peer. It should be called once during
+// node startup, before the first GetNodeAddr/GetNodeInfo/PingBP call.
+func InitNodeDB(path string, selfID proto.RawNodeID, cycle, expiration time.Duration) (err error) {
+	db, err := NewNodeDB(path, selfID, cycle, expiration)
+	if err != nil {
+		return
+	}
+	nodeDB.Store(db)
+
+	var seeded int
+	err = db.Range(func(id proto.RawNodeID, info *NodeInfo) bool {
+		if setErr := SetNodeAddrCache(&id, info.Node.Addr); setErr == nil {
+			seeded++
+		}
+		return true
+	})
+	if err != nil {
+		log.WithError(err).Error("seed address cache from node db failed")
+		return
+	}
+	log.WithField("count", seeded).Info("seeded address cache from node db")
+	return
+}
+
+// GetNodeDB returns the process-wide NodeDB, or nil if InitNodeDB has not
+// been called (e.g. in tests or tools that don't need persistence).
+func GetNodeDB() *NodeDB {
+	db, _ := nodeDB.Load().(*NodeDB)
+	return db
+}
+
+// TouchLastSeen updates the on-disk last-seen field for id, if persistence
+// is enabled. Callers should not treat a failure here as fatal: the node db
+// is an optimization, not the source of truth.
+func TouchLastSeen(id *proto.RawNodeID, node *proto.Node) {
+	if db := GetNodeDB(); db != nil {
+		if err := db.UpdateLastSeen(id, node); err != nil {
+			log.WithField("node", id).WithError(err).Warn("update last seen failed")
+		}
+	}
+}
+
+// TouchPingSuccess updates the on-disk last-ping-success/RTT fields for id,
+// if persistence is enabled.
+func TouchPingSuccess(id *proto.RawNodeID, rtt time.Duration) {
+	if db := GetNodeDB(); db != nil {
+		if err := db.UpdatePingSuccess(id, rtt); err != nil {
+			log.WithField("node", id).WithError(err).Warn("update ping success failed")
+		}
+	}
+}
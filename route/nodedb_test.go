@@ -0,0 +1,182 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package route
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"gitlab.com/thunderdb/ThunderDB/proto"
+)
+
+func newTestNodeDB(t *testing.T, selfID proto.RawNodeID) *NodeDB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "node.db")
+	db, err := NewNodeDB(path, selfID, time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewNodeDB failed: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func testNodeID(b byte) (id proto.RawNodeID) {
+	id[0] = b
+	return
+}
+
+func TestNodeDB_SetGetRoundTrip(t *testing.T) {
+	db := newTestNodeDB(t, testNodeID(0))
+	id := testNodeID(1)
+
+	if info, err := db.Get(&id); err != nil {
+		t.Fatalf("Get on unknown id failed: %s", err)
+	} else if info != nil {
+		t.Fatalf("expected no info for unknown id, got %+v", info)
+	}
+
+	want := &NodeInfo{
+		Node:     proto.Node{Addr: "127.0.0.1:2121"},
+		LastSeen: time.Now().Truncate(time.Second),
+	}
+	if err := db.Set(&id, want); err != nil {
+		t.Fatalf("Set failed: %s", err)
+	}
+
+	got, err := db.Get(&id)
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if got == nil || got.Node.Addr != want.Node.Addr || !got.LastSeen.Equal(want.LastSeen) {
+		t.Fatalf("round trip mismatch: want %+v, got %+v", want, got)
+	}
+}
+
+func TestNodeDB_UpdateLastSeenAndPingSuccessDontClobber(t *testing.T) {
+	db := newTestNodeDB(t, testNodeID(0))
+	id := testNodeID(1)
+	node := &proto.Node{Addr: "127.0.0.1:2121"}
+
+	if err := db.UpdateLastSeen(&id, node); err != nil {
+		t.Fatalf("UpdateLastSeen failed: %s", err)
+	}
+	if err := db.UpdatePingSuccess(&id, 42*time.Millisecond); err != nil {
+		t.Fatalf("UpdatePingSuccess failed: %s", err)
+	}
+
+	info, err := db.Get(&id)
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	if info == nil {
+		t.Fatal("expected a persisted record, got nil")
+	}
+	if info.LastSeen.IsZero() {
+		t.Error("expected LastSeen set by UpdateLastSeen to survive UpdatePingSuccess, got zero value")
+	}
+	if info.RTT != 42*time.Millisecond || info.LastPingSuccess.IsZero() {
+		t.Errorf("expected RTT/LastPingSuccess set by UpdatePingSuccess, got %+v", info)
+	}
+	if info.Node.Addr != node.Addr {
+		t.Errorf("expected Node set by UpdateLastSeen to survive, got %+v", info.Node)
+	}
+}
+
+func TestNodeDB_CleanupExpiredDropsStaleSkipsSelf(t *testing.T) {
+	selfID := testNodeID(0)
+	db := newTestNodeDB(t, selfID)
+	db.expiration = time.Hour
+
+	stale, fresh := testNodeID(1), testNodeID(2)
+	for _, tc := range []struct {
+		id       proto.RawNodeID
+		lastSeen time.Time
+	}{
+		{selfID, time.Now().Add(-2 * time.Hour)}, // stale but must never be dropped
+		{stale, time.Now().Add(-2 * time.Hour)},
+		{fresh, time.Now()},
+	} {
+		if err := db.Set(&tc.id, &NodeInfo{LastSeen: tc.lastSeen}); err != nil {
+			t.Fatalf("Set(%x) failed: %s", tc.id, err)
+		}
+	}
+
+	db.cleanupExpired()
+
+	remaining := make(map[proto.RawNodeID]bool)
+	if err := db.Range(func(id proto.RawNodeID, info *NodeInfo) bool {
+		remaining[id] = true
+		return true
+	}); err != nil {
+		t.Fatalf("Range failed: %s", err)
+	}
+
+	if !remaining[selfID] {
+		t.Error("expected selfID to survive cleanup despite being stale")
+	}
+	if remaining[stale] {
+		t.Error("expected stale entry to be dropped by cleanup")
+	}
+	if !remaining[fresh] {
+		t.Error("expected fresh entry to survive cleanup")
+	}
+}
+
+func TestNewNodeDB_WipesIncompatibleSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.db")
+
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("bolt.Open failed: %s", err)
+	}
+	if err := bdb.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket(nodeDBBucketName)
+		if err != nil {
+			return err
+		}
+		// a key stamped with a schema version this package doesn't know.
+		return bucket.Put([]byte{nodeDBSchemaVersion + 1, 0xAA}, []byte("stale"))
+	}); err != nil {
+		t.Fatalf("seeding stale schema failed: %s", err)
+	}
+	if err := bdb.Close(); err != nil {
+		t.Fatalf("closing seed db failed: %s", err)
+	}
+
+	db, err := NewNodeDB(path, testNodeID(0), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("NewNodeDB failed: %s", err)
+	}
+	defer db.Close()
+
+	// count raw keys: Range skips stale-version keys, so it would report zero
+	// entries even if the bucket had not been wiped.
+	var count int
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodeDBBucketName).ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+	}); err != nil {
+		t.Fatalf("counting raw node db keys failed: %s", err)
+	}
+	if count != 0 {
+		t.Errorf("expected the incompatible-schema bucket to be wiped, found %d entries", count)
+	}
+}
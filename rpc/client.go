@@ -0,0 +1,175 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// ErrShutdown is returned by pending and future calls once a Client has been
+// closed, either explicitly or because its underlying stream died.
+var ErrShutdown = errors.New("rpc: client is shut down")
+
+// pendingCall tracks a request this Client is waiting on a response for.
+type pendingCall struct {
+	reply interface{}
+	done  chan error
+}
+
+// Client issues calls framed with frame, multiplexing any number of
+// concurrent calls (and their cancellations) over a single underlying
+// stream. It replaces the bare net/rpc gob codec, which had no way to tell
+// the server a caller had given up.
+type Client struct {
+	conn io.ReadWriteCloser
+	w    *frameWriter
+	r    *frameReader
+
+	nextCallID uint64
+
+	mu       sync.Mutex
+	pending  map[uint64]*pendingCall
+	shutdown bool
+}
+
+// NewClient wraps conn (typically a *yamux.Stream) in the call/cancel
+// framing protocol and starts its response-reading loop.
+func NewClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:    conn,
+		w:       newFrameWriter(conn),
+		r:       newFrameReader(conn),
+		pending: make(map[uint64]*pendingCall),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Call invokes method on the peer with args, blocking until reply is
+// populated, ctx is done, or the connection goes away. When ctx is done
+// before the response arrives, Call sends a cancel frame so the server can
+// stop the in-flight handler instead of computing an answer nobody reads.
+func (c *Client) Call(ctx context.Context, method string, args, reply interface{}) (err error) {
+	callID := atomic.AddUint64(&c.nextCallID, 1)
+	logger := log.WithField("method", method).WithField("call_id", callID)
+
+	var body bytes.Buffer
+	if err = gob.NewEncoder(&body).Encode(args); err != nil {
+		logger.WithError(err).Error("encode call args failed")
+		return
+	}
+
+	call := &pendingCall{reply: reply, done: make(chan error, 1)}
+
+	c.mu.Lock()
+	if c.shutdown {
+		c.mu.Unlock()
+		return ErrShutdown
+	}
+	c.pending[callID] = call
+	c.mu.Unlock()
+
+	if err = c.w.write(&frame{Type: frameRequest, CallID: callID, Method: method, Body: body.Bytes()}); err != nil {
+		c.removePending(callID)
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		// best effort: let the server know nobody is listening anymore.
+		logger.Debug("call context done, sending cancel frame")
+		_ = c.w.write(&frame{Type: frameCancel, CallID: callID})
+		c.removePending(callID)
+		return ctx.Err()
+	case err = <-call.done:
+		return
+	}
+}
+
+func (c *Client) removePending(callID uint64) *pendingCall {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call := c.pending[callID]
+	delete(c.pending, callID)
+	return call
+}
+
+func (c *Client) readLoop() {
+	for {
+		var f frame
+		if err := c.r.read(&f); err != nil {
+			c.shutdownPending(err)
+			return
+		}
+		if f.Type != frameResponse {
+			continue
+		}
+		call := c.removePending(f.CallID)
+		if call == nil {
+			// nobody is waiting (already cancelled / timed out)
+			continue
+		}
+		var err error
+		if f.Err != "" {
+			err = errors.New(f.Err)
+		} else if len(f.Body) > 0 {
+			err = gob.NewDecoder(bytes.NewReader(f.Body)).Decode(call.reply)
+		}
+		call.done <- err
+	}
+}
+
+func (c *Client) shutdownPending(readErr error) {
+	c.mu.Lock()
+	c.shutdown = true
+	pending := c.pending
+	c.pending = make(map[uint64]*pendingCall)
+	c.mu.Unlock()
+
+	for _, call := range pending {
+		call.done <- ErrShutdown
+	}
+	if readErr != io.EOF {
+		log.WithError(readErr).Debug("rpc client read loop stopped")
+	}
+}
+
+// Close closes the underlying connection and fails any call still waiting
+// on a response.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.shutdownPending(ErrShutdown)
+	return err
+}
+
+// IsClosed reports whether this Client has shut down, either because Close
+// was called or because its read loop hit an error (e.g. the peer went
+// away). ClientPool uses this to evict a dead client instead of handing it
+// back out.
+func (c *Client) IsClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shutdown
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// pingArgs/pingReply/echoArgs/echoReply stand in for proto.PingReq/PingResp
+// and a synthetic SQL echo call: real types live in the proto package,
+// which these benchmarks don't need to exercise the pool/no-pool cost.
+type pingArgs struct{}
+type pingReply struct{}
+type echoArgs struct{ Msg string }
+type echoReply struct{ Msg string }
+
+type benchDHTService struct{}
+
+func (benchDHTService) Ping(args *pingArgs, reply *pingReply) error {
+	return nil
+}
+
+type benchSQLService struct{}
+
+func (benchSQLService) Echo(args *echoArgs, reply *echoReply) error {
+	reply.Msg = args.Msg
+	return nil
+}
+
+func newBenchServer(b *testing.B) *Server {
+	s := NewServer()
+	if err := s.RegisterName("DHT", benchDHTService{}); err != nil {
+		b.Fatalf("register DHT service failed: %s", err)
+	}
+	if err := s.RegisterName("SQL", benchSQLService{}); err != nil {
+		b.Fatalf("register SQL service failed: %s", err)
+	}
+	return s
+}
+
+// BenchmarkCallNode_DHTPing_NewClientPerCall dials a fresh in-process stream
+// and *Client for every call, mirroring CallNodeWithContext before a
+// ClientPool was wired in: every call pays for a new connection setup.
+func BenchmarkCallNode_DHTPing_NewClientPerCall(b *testing.B) {
+	benchmarkNewClientPerCall(b, "DHT.Ping", new(pingArgs), new(pingReply))
+}
+
+// BenchmarkCallNode_DHTPing_PooledClient reuses one *Client (as a
+// ClientPool-backed Caller would) across every call.
+func BenchmarkCallNode_DHTPing_PooledClient(b *testing.B) {
+	benchmarkPooledClient(b, "DHT.Ping", new(pingArgs), new(pingReply))
+}
+
+// BenchmarkCallNode_SQLEcho_NewClientPerCall is the synthetic SQL echo
+// equivalent of BenchmarkCallNode_DHTPing_NewClientPerCall.
+func BenchmarkCallNode_SQLEcho_NewClientPerCall(b *testing.B) {
+	benchmarkNewClientPerCall(b, "SQL.Echo", &echoArgs{Msg: "ping"}, new(echoReply))
+}
+
+// BenchmarkCallNode_SQLEcho_PooledClient is the synthetic SQL echo
+// equivalent of BenchmarkCallNode_DHTPing_PooledClient.
+func BenchmarkCallNode_SQLEcho_PooledClient(b *testing.B) {
+	benchmarkPooledClient(b, "SQL.Echo", &echoArgs{Msg: "ping"}, new(echoReply))
+}
+
+func benchmarkNewClientPerCall(b *testing.B, method string, args, reply interface{}) {
+	server := newBenchServer(b)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientConn, serverConn := net.Pipe()
+		go server.ServeCodec(serverConn)
+
+		client := NewClient(clientConn)
+		if err := client.Call(ctx, method, args, reply); err != nil {
+			b.Fatalf("call failed: %s", err)
+		}
+		client.Close()
+	}
+}
+
+func benchmarkPooledClient(b *testing.B, method string, args, reply interface{}) {
+	server := newBenchServer(b)
+	ctx := context.Background()
+
+	clientConn, serverConn := net.Pipe()
+	go server.ServeCodec(serverConn)
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := client.Call(ctx, method, args, reply); err != nil {
+			b.Fatalf("call failed: %s", err)
+		}
+	}
+}
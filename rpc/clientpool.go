@@ -0,0 +1,192 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"gitlab.com/thunderdb/ThunderDB/proto"
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// DefaultClientPoolSizePerNode bounds how many idle *Client connections
+// ClientPool keeps warm for a single node when no size is given.
+const DefaultClientPoolSizePerNode = 4
+
+// PoolStats is a point-in-time snapshot of ClientPool's Prometheus-style
+// counters, handed back so operators can size the pool.
+type PoolStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+// clientPoolKey identifies one of the two distinct sessions a node can have:
+// its authenticated ETLS session, and the anonymous one used for DHT.Ping.
+// A *Client dialed for one must never be handed back out for the other.
+type clientPoolKey struct {
+	node      proto.NodeID
+	anonymous bool
+}
+
+// ClientPool is the sibling of SessionPool one layer up: SessionPool caches
+// the long-lived yamux sessions, ClientPool caches initialized *Client
+// instances built on top of them, so CallNodeWithContext no longer pays for
+// a fresh stream + handshake on every call.
+type ClientPool struct {
+	sessions *SessionPool
+	maxIdle  int
+
+	mu   sync.Mutex
+	idle map[clientPoolKey][]*Client
+
+	inFlight sync.Map // clientPoolKey -> *int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+// NewClientPool returns a ClientPool that dials through sessions and keeps
+// up to maxIdle warm *Client connections per node. maxIdle <= 0 defaults to
+// DefaultClientPoolSizePerNode.
+func NewClientPool(sessions *SessionPool, maxIdle int) *ClientPool {
+	if maxIdle <= 0 {
+		maxIdle = DefaultClientPoolSizePerNode
+	}
+	return &ClientPool{
+		sessions: sessions,
+		maxIdle:  maxIdle,
+		idle:     make(map[clientPoolKey][]*Client),
+	}
+}
+
+var defaultClientPool struct {
+	once sync.Once
+	pool *ClientPool
+}
+
+// DefaultClientPool returns the process-wide ClientPool built on top of
+// GetSessionPoolInstance(), lazily created on first use. GetNodeAddr,
+// GetNodeInfo, and PingBP borrow through it so repeated lookups/pings reuse
+// a warm *Client instead of paying for a fresh stream and handshake every
+// call.
+func DefaultClientPool() *ClientPool {
+	defaultClientPool.once.Do(func() {
+		defaultClientPool.pool = NewClientPool(GetSessionPoolInstance(), DefaultClientPoolSizePerNode)
+	})
+	return defaultClientPool.pool
+}
+
+// Get returns a *Client for node, reusing a pooled one when a healthy one is
+// idle and dialing a fresh stream otherwise. anonymous selects which of
+// node's two sessions (authenticated or the anonymous one DHT.Ping uses) to
+// pool against; a *Client dialed for one is never handed back out for the
+// other.
+func (p *ClientPool) Get(node proto.NodeID, anonymous bool) (client *Client, err error) {
+	key := clientPoolKey{node: node, anonymous: anonymous}
+
+	p.mu.Lock()
+	stack := p.idle[key]
+	for len(stack) > 0 {
+		client, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		if client.IsClosed() {
+			atomic.AddInt64(&p.evictions, 1)
+			client = nil
+			continue
+		}
+		p.idle[key] = stack
+		atomic.AddInt64(&p.hits, 1)
+		p.mu.Unlock()
+		p.adjustInFlight(key, 1)
+		return
+	}
+	p.idle[key] = stack
+	p.mu.Unlock()
+
+	atomic.AddInt64(&p.misses, 1)
+	conn, err := DialToNode(node, p.sessions, anonymous)
+	if err != nil {
+		log.WithField("node", node).WithError(err).Error("dialing to node for client pool failed")
+		return
+	}
+	client = NewClient(conn)
+	p.adjustInFlight(key, 1)
+	return
+}
+
+// Put returns client to the idle pool for reuse, unless callErr indicates
+// the underlying session is gone (rpc.ErrShutdown) or the client has
+// already torn itself down, in which case it is evicted and closed instead.
+// anonymous must match the value passed to the Get call client came from.
+func (p *ClientPool) Put(node proto.NodeID, anonymous bool, client *Client, callErr error) {
+	key := clientPoolKey{node: node, anonymous: anonymous}
+	p.adjustInFlight(key, -1)
+
+	if callErr == ErrShutdown || client.IsClosed() {
+		atomic.AddInt64(&p.evictions, 1)
+		client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[key]) >= p.maxIdle {
+		client.Close()
+		return
+	}
+	p.idle[key] = append(p.idle[key], client)
+}
+
+func (p *ClientPool) adjustInFlight(key clientPoolKey, delta int64) {
+	v, _ := p.inFlight.LoadOrStore(key, new(int64))
+	atomic.AddInt64(v.(*int64), delta)
+}
+
+// InFlight returns the number of calls currently borrowed from the pool for
+// node's session selected by anonymous.
+func (p *ClientPool) InFlight(node proto.NodeID, anonymous bool) int64 {
+	v, ok := p.inFlight.Load(clientPoolKey{node: node, anonymous: anonymous})
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(v.(*int64))
+}
+
+// Stats returns a snapshot of the pool's hit/miss/eviction counters.
+func (p *ClientPool) Stats() PoolStats {
+	return PoolStats{
+		Hits:      atomic.LoadInt64(&p.hits),
+		Misses:    atomic.LoadInt64(&p.misses),
+		Evictions: atomic.LoadInt64(&p.evictions),
+	}
+}
+
+// Close evicts and closes every idle client in the pool.
+func (p *ClientPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[clientPoolKey][]*Client)
+	p.mu.Unlock()
+
+	for _, clients := range idle {
+		for _, client := range clients {
+			client.Close()
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"encoding/gob"
+	"io"
+	"sync"
+)
+
+// frameType distinguishes the handful of message shapes that can appear on a
+// call stream. Requests and their responses carry a callID so several calls
+// can be in flight on the same yamux stream at once; cancel frames use that
+// same callID to tell the peer to stop working on a call that no longer has
+// a listener.
+type frameType uint8
+
+const (
+	frameRequest frameType = iota
+	frameResponse
+	frameCancel
+)
+
+// frame is the wire representation of every message exchanged on a call
+// stream, gob-encoded one after another on a single encoder/decoder pair.
+type frame struct {
+	Type   frameType
+	CallID uint64
+	Method string // set on frameRequest
+	Body   []byte // gob-encoded args (request) or reply (response)
+	Err    string // set on frameResponse when the call failed
+}
+
+// frameWriter serializes frame writes over a shared gob.Encoder: multiple
+// goroutines may be composing responses (or cancellations) concurrently for
+// the same stream, but gob.Encoder is not safe for concurrent use.
+type frameWriter struct {
+	mu  sync.Mutex
+	enc *gob.Encoder
+}
+
+func newFrameWriter(w io.Writer) *frameWriter {
+	return &frameWriter{enc: gob.NewEncoder(w)}
+}
+
+func (fw *frameWriter) write(f *frame) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.enc.Encode(f)
+}
+
+// frameReader is a thin wrapper so both client and server read frames the
+// same way; gob.Decoder already serializes its own reads, but wrapping it
+// keeps the read side symmetric with frameWriter and gives us one place to
+// adjust framing later.
+type frameReader struct {
+	dec *gob.Decoder
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{dec: gob.NewDecoder(r)}
+}
+
+func (fr *frameReader) read(f *frame) error {
+	return fr.dec.Decode(f)
+}
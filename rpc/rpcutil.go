@@ -18,7 +18,8 @@ package rpc
 
 import (
 	"context"
-	"net/rpc"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/yamux"
 	"gitlab.com/thunderdb/ThunderDB/crypto/kms"
@@ -27,19 +28,52 @@ import (
 	"gitlab.com/thunderdb/ThunderDB/utils/log"
 )
 
+// callSeq assigns a process-wide, monotonic call_id to every RPC call so
+// its start/completion log lines can be correlated even across nodes and
+// methods.
+var callSeq uint64
+
+// callLogger starts a structured logger carrying the node, method, and a
+// fresh call_id for a single CallNodeWithContext invocation.
+func callLogger(node proto.NodeID, method string) *log.Logger {
+	callID := atomic.AddUint64(&callSeq, 1)
+	return log.WithField("node", node).WithField("method", method).WithField("call_id", callID)
+}
+
 // Caller is a wrapper for session pooling and RPC calling.
 type Caller struct {
-	pool *SessionPool
+	pool       *SessionPool
+	clientPool *ClientPool
+}
+
+// CallerOption configures a Caller returned by NewCaller.
+type CallerOption func(*Caller)
+
+// WithClientPool makes the Caller borrow/return *Client instances through
+// pool instead of dialing a fresh stream for every call.
+func WithClientPool(pool *ClientPool) CallerOption {
+	return func(c *Caller) {
+		c.clientPool = pool
+	}
 }
 
 // NewCaller returns a new RPCCaller.
-func NewCaller() *Caller {
-	return &Caller{
+func NewCaller(opts ...CallerOption) *Caller {
+	c := &Caller{
 		pool: GetSessionPoolInstance(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// pooledCaller returns a Caller that borrows/returns connections through
+// DefaultClientPool, instead of dialing a fresh stream per call.
+func pooledCaller() *Caller {
+	return NewCaller(WithClientPool(DefaultClientPool()))
 }
 
-//TODO(auxten) maybe a rpc client pool will gain much more performance
 // CallNode invokes the named function, waits for it to complete, and returns its error status.
 func (c *Caller) CallNode(
 	node proto.NodeID, method string, args interface{}, reply interface{}) (err error) {
@@ -47,39 +81,63 @@ func (c *Caller) CallNode(
 }
 
 // CallNodeWithContext invokes the named function, waits for it to complete or context timeout, and returns its error status.
+// Unlike the net/rpc gob codec this used to ride on, the underlying Client
+// tells the server to stop working on the call the moment ctx fires, rather
+// than merely abandoning the response on this end.
 func (c *Caller) CallNodeWithContext(
 	ctx context.Context, node proto.NodeID, method string, args interface{}, reply interface{}) (err error) {
-	conn, err := DialToNode(node, c.pool, method == route.DHTPing.String())
+	anonymous := method == route.DHTPing.String()
+	logger := callLogger(node, method)
+	logger.Debug("call start")
+	start := time.Now()
+
+	defer func() {
+		l := logger.WithField("duration_ms", time.Since(start).Milliseconds())
+		if err != nil {
+			l.WithError(err).Error("call failed")
+		} else {
+			l.Info("call completed")
+		}
+	}()
+
+	if c.clientPool != nil {
+		client, clientErr := c.clientPool.Get(node, anonymous)
+		if clientErr != nil {
+			err = clientErr
+			logger.WithError(err).Error("borrowing client from pool failed")
+			return
+		}
+		err = client.Call(ctx, method, args, reply)
+		c.clientPool.Put(node, anonymous, client, err)
+		if err == nil {
+			route.TouchLastSeen(node.ToRawNodeID(), nil)
+		}
+		return
+	}
+
+	conn, err := DialToNode(node, c.pool, anonymous)
 	if err != nil {
-		log.Errorf("dialing to node: %s failed: %s", node, err)
+		logger.WithError(err).Error("dialing to node failed")
 		return
 	}
 
 	defer func() {
 		// call the yamux stream Close explicitly
-		//TODO(auxten) maybe a rpc client pool will gain much more performance
+		// note: NewCaller(WithClientPool(...)) avoids paying this dial/close
+		// cost on every call by reusing long-lived *Client connections.
 		stream, ok := conn.(*yamux.Stream)
 		if ok {
 			stream.Close()
 		}
 	}()
 
-	client, err := InitClientConn(conn)
-	if err != nil {
-		log.Errorf("init RPC client failed: %s", err)
-		return
-	}
-
+	client := NewClient(conn)
 	defer client.Close()
 
-	// TODO(xq262144), golang net/rpc does not support cancel in progress calls
-	ch := client.Go(method, args, reply, make(chan *rpc.Call, 1))
-
-	select {
-	case <-ctx.Done():
-		err = ctx.Err()
-	case call := <-ch.Done:
-		err = call.Error
+	err = client.Call(ctx, method, args, reply)
+	if err == nil {
+		rawID := node.ToRawNodeID()
+		route.TouchLastSeen(rawID, nil)
 	}
 
 	return
@@ -87,35 +145,21 @@ func (c *Caller) CallNodeWithContext(
 
 // GetNodeAddr tries best to get node addr
 func GetNodeAddr(id *proto.RawNodeID) (addr string, err error) {
+	logger := log.WithField("node", id)
+
 	addr, err = route.GetNodeAddrCache(id)
 	if err != nil {
-		log.Infof("get node \"%s\" addr failed: %s", addr, err)
+		logger.WithError(err).Debug("address cache miss")
 		if err == route.ErrUnknownNodeID {
-			BPs := route.GetBPs()
-			if len(BPs) == 0 {
-				log.Errorf("no available BP")
+			var node *proto.Node
+			node, err = route.LookupNode(context.Background(), id, pooledCaller(), 0)
+			if err != nil {
+				logger.WithError(err).Error("lookup node via BPs failed")
 				return
 			}
-			client := NewCaller()
-			reqFN := &proto.FindNodeReq{
-				NodeID: proto.NodeID(id.String()),
-			}
-			respFN := new(proto.FindNodeResp)
-
-			// TODO(auxten) add some random here for bp selection
-			for _, bp := range BPs {
-				method := "DHT.FindNode"
-				err = client.CallNode(bp, method, reqFN, respFN)
-				if err != nil {
-					log.Errorf("call %s %s failed: %s", bp, method, err)
-					continue
-				}
-				break
-			}
-			if err == nil {
-				route.SetNodeAddrCache(id, respFN.Node.Addr)
-				addr = respFN.Node.Addr
-			}
+			route.SetNodeAddrCache(id, node.Addr)
+			route.TouchLastSeen(id, node)
+			addr = node.Addr
 		}
 	}
 	return
@@ -123,42 +167,24 @@ func GetNodeAddr(id *proto.RawNodeID) (addr string, err error) {
 
 // GetNodeInfo tries best to get node info
 func GetNodeInfo(id *proto.RawNodeID) (nodeInfo *proto.Node, err error) {
+	logger := log.WithField("node", id)
+
 	nodeInfo, err = kms.GetNodeInfo(proto.NodeID(id.String()))
 	if err != nil {
-		log.Infof("get node info from KMS for %s failed: %s", id, err)
+		logger.WithError(err).Debug("kms node info miss")
 		if err == kms.ErrKeyNotFound {
-			BPs := route.GetBPs()
-			if len(BPs) == 0 {
-				log.Errorf("no available BP")
+			nodeInfo, err = route.LookupNode(context.Background(), id, pooledCaller(), 0)
+			if err != nil {
+				logger.WithError(err).Error("lookup node via BPs failed")
 				return
 			}
-			client := NewCaller()
-			reqFN := &proto.FindNodeReq{
-				NodeID: proto.NodeID(id.String()),
+			if errSet := route.SetNodeAddrCache(id, nodeInfo.Addr); errSet != nil {
+				logger.WithError(errSet).Error("set node addr cache failed")
 			}
-			respFN := new(proto.FindNodeResp)
-
-			// TODO(auxten) add some random here for bp selection
-			for _, bp := range BPs {
-				method := "DHT.FindNode"
-				err = client.CallNode(bp, method, reqFN, respFN)
-				if err != nil {
-					log.Errorf("call %s %s failed: %s", bp, method, err)
-					continue
-				}
-				break
-			}
-			if err == nil {
-				nodeInfo = respFN.Node
-				errSet := route.SetNodeAddrCache(id, nodeInfo.Addr)
-				if errSet != nil {
-					log.Warnf("set node addr cache failed: %v", errSet)
-				}
-				errSet = kms.SetNode(nodeInfo)
-				if errSet != nil {
-					log.Warnf("set node to kms failed: %v", errSet)
-				}
+			if errSet := kms.SetNode(nodeInfo); errSet != nil {
+				logger.WithError(errSet).Error("set node to kms failed")
 			}
+			route.TouchLastSeen(id, nodeInfo)
 		}
 	}
 	return
@@ -166,19 +192,24 @@ func GetNodeInfo(id *proto.RawNodeID) (nodeInfo *proto.Node, err error) {
 
 // PingBP Send DHT.Ping Request with Anonymous ETLS session
 func PingBP(node *proto.Node, BPNodeID proto.NodeID) (err error) {
-	client := NewCaller()
+	logger := log.WithField("node", BPNodeID).WithField("method", "DHT.Ping")
+	client := pooledCaller()
 
 	req := &proto.PingReq{
 		Node: *node,
 	}
 
 	resp := new(proto.PingResp)
+	start := time.Now()
 	err = client.CallNode(BPNodeID, "DHT.Ping", req, resp)
+	rtt := time.Since(start)
 	if err != nil {
-		log.Errorf("call DHT.Ping failed: %v", err)
+		logger.WithField("duration_ms", rtt.Milliseconds()).WithError(err).Error("ping failed")
 		return
 	}
-	log.Debugf("PingBP resp: %v", resp)
+	logger.WithField("duration_ms", rtt.Milliseconds()).Debug("ping completed")
+
+	route.TouchPingSuccess(BPNodeID.ToRawNodeID(), rtt)
 
 	return
 }
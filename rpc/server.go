@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"gitlab.com/thunderdb/ThunderDB/utils/log"
+)
+
+// Handler is the signature every registered method is normalized to. Unlike
+// net/rpc's func(args, reply) error, it is handed a context that is
+// cancelled the moment the caller sends a frameCancel for this call, so a
+// long DHT/SQL handler actually has something to select on.
+type Handler func(ctx context.Context, args, reply interface{}) error
+
+type method struct {
+	handler   Handler
+	argType   reflect.Type
+	replyType reflect.Type
+}
+
+// Server dispatches frames read off a call stream to registered methods,
+// tracking one context.CancelFunc per in-flight call so a frameCancel can
+// stop it.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]*method
+}
+
+// NewServer returns an empty Server ready for RegisterName calls.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]*method)}
+}
+
+// RegisterName registers every exported method of rcvr under "name.Method".
+// A method may use either the new ctx-aware signature,
+// func(ctx context.Context, args, reply interface{}) error, or the legacy
+// func(args, reply interface{}) error, which is wrapped into a Handler that
+// simply ignores the context. This lets existing DHT/SQL services move onto
+// the cancellable transport without being rewritten up front.
+func (s *Server) RegisterName(name string, rcvr interface{}) error {
+	rv := reflect.ValueOf(rcvr)
+	rt := rv.Type()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var registered int
+	for i := 0; i < rt.NumMethod(); i++ {
+		m := rt.Method(i)
+		h, argType, replyType, ok := wrapMethod(rv, m)
+		if !ok {
+			continue
+		}
+		s.methods[name+"."+m.Name] = &method{handler: h, argType: argType, replyType: replyType}
+		registered++
+	}
+	if registered == 0 {
+		return fmt.Errorf("rpc: %T has no usable methods", rcvr)
+	}
+	return nil
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// wrapMethod normalizes either supported method shape into a Handler plus
+// the concrete types callers should decode args/reply into.
+func wrapMethod(rv reflect.Value, m reflect.Method) (h Handler, argType, replyType reflect.Type, ok bool) {
+	mt := m.Func.Type()
+
+	switch mt.NumIn() {
+	case 3: // receiver, args, reply -> legacy func(args, reply) error
+		if mt.In(1).Kind() != reflect.Ptr || mt.In(2).Kind() != reflect.Ptr {
+			return
+		}
+		if mt.NumOut() != 1 || mt.Out(0) != errorType {
+			return
+		}
+		argType, replyType = mt.In(1), mt.In(2)
+		fn := m.Func
+		h = func(_ context.Context, args, reply interface{}) error {
+			out := fn.Call([]reflect.Value{rv, reflect.ValueOf(args), reflect.ValueOf(reply)})
+			return asError(out[0])
+		}
+		ok = true
+	case 4: // receiver, ctx, args, reply -> func(ctx, args, reply) error
+		if mt.In(1) != ctxType {
+			return
+		}
+		if mt.NumOut() != 1 || mt.Out(0) != errorType {
+			return
+		}
+		argType, replyType = mt.In(2), mt.In(3)
+		fn := m.Func
+		h = func(ctx context.Context, args, reply interface{}) error {
+			out := fn.Call([]reflect.Value{rv, reflect.ValueOf(ctx), reflect.ValueOf(args), reflect.ValueOf(reply)})
+			return asError(out[0])
+		}
+		ok = true
+	}
+	return
+}
+
+func asError(v reflect.Value) error {
+	if v.IsNil() {
+		return nil
+	}
+	return v.Interface().(error)
+}
+
+// ServeCodec reads frames off conn until it is closed, dispatching each
+// frameRequest to its registered Handler in its own goroutine and handling
+// frameCancel by invoking the matching call's context.CancelFunc. Multiple
+// calls may be in flight on conn at once.
+func (s *Server) ServeCodec(conn io.ReadWriteCloser) {
+	w := newFrameWriter(conn)
+	r := newFrameReader(conn)
+
+	var cancels sync.Map // callID -> context.CancelFunc
+
+	for {
+		var f frame
+		if err := r.read(&f); err != nil {
+			if err != io.EOF {
+				log.WithError(err).Debug("rpc server stream closed")
+			}
+			// The peer is gone without a chance to send frameCancel for
+			// whatever it still had in flight (hard disconnect, network
+			// drop, reset) -- cancel every outstanding call ourselves so
+			// invoke goroutines stop instead of running to completion.
+			cancels.Range(func(_, cancel interface{}) bool {
+				cancel.(context.CancelFunc)()
+				return true
+			})
+			return
+		}
+
+		switch f.Type {
+		case frameCancel:
+			if cancel, ok := cancels.Load(f.CallID); ok {
+				cancel.(context.CancelFunc)()
+				cancels.Delete(f.CallID)
+			}
+		case frameRequest:
+			logger := log.WithField("method", f.Method).WithField("call_id", f.CallID)
+			m, ok := s.lookup(f.Method)
+			if !ok {
+				logger.Error("unknown method")
+				_ = w.write(&frame{Type: frameResponse, CallID: f.CallID, Err: fmt.Sprintf("rpc: unknown method %s", f.Method)})
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancels.Store(f.CallID, cancel)
+			go s.invoke(ctx, cancel, &cancels, w, f, m, logger)
+		}
+	}
+}
+
+func (s *Server) lookup(name string) (*method, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.methods[name]
+	return m, ok
+}
+
+func (s *Server) invoke(ctx context.Context, cancel context.CancelFunc, cancels *sync.Map, w *frameWriter, f frame, m *method, logger *log.Logger) {
+	logger.Debug("call start")
+	start := time.Now()
+
+	defer func() {
+		cancel()
+		cancels.Delete(f.CallID)
+	}()
+
+	args := reflect.New(m.argType.Elem())
+	if err := gob.NewDecoder(bytes.NewReader(f.Body)).Decode(args.Interface()); err != nil {
+		logger.WithError(err).Error("decode call args failed")
+		_ = w.write(&frame{Type: frameResponse, CallID: f.CallID, Err: err.Error()})
+		return
+	}
+	reply := reflect.New(m.replyType.Elem())
+
+	err := m.handler(ctx, args.Interface(), reply.Interface())
+
+	l := logger.WithField("duration_ms", time.Since(start).Milliseconds())
+	resp := &frame{Type: frameResponse, CallID: f.CallID}
+	if err != nil {
+		resp.Err = err.Error()
+		l.WithError(err).Error("call failed")
+	} else {
+		var body bytes.Buffer
+		if encErr := gob.NewEncoder(&body).Encode(reply.Interface()); encErr != nil {
+			resp.Err = encErr.Error()
+			l.WithError(encErr).Error("encode reply failed")
+		} else {
+			resp.Body = body.Bytes()
+			l.Info("call completed")
+		}
+	}
+	_ = w.write(resp)
+}
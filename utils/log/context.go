@@ -0,0 +1,72 @@
+/*
+ * Copyright 2018 The ThunderDB Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package log
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Logger wraps a logrus.Entry so callers can accumulate key/value context
+// -- node, method, call_id, remote_addr, duration_ms, err -- across a
+// request instead of concatenating identifiers into a message string the
+// way Errorf/Infof do. It is immutable: each WithXxx call returns a new
+// Logger, so the same base logger can safely seed many concurrent calls.
+type Logger struct {
+	entry *logrus.Entry
+}
+
+// WithField starts a new Logger carrying key=value.
+func WithField(key string, value interface{}) *Logger {
+	base := &Logger{entry: logrus.NewEntry(logrus.StandardLogger())}
+	return base.WithField(key, value)
+}
+
+// WithField returns a copy of l with key=value added to its context.
+func (l *Logger) WithField(key string, value interface{}) *Logger {
+	return &Logger{entry: l.entry.WithField(key, value)}
+}
+
+// WithError starts a new Logger with err recorded under the "err" field.
+func WithError(err error) *Logger {
+	base := &Logger{entry: logrus.NewEntry(logrus.StandardLogger())}
+	return base.WithError(err)
+}
+
+// WithError returns a copy of l with err recorded under the "err" field.
+func (l *Logger) WithError(err error) *Logger {
+	return &Logger{entry: l.entry.WithField("err", err)}
+}
+
+// Debug emits msg at debug level with the accumulated field context.
+func (l *Logger) Debug(msg string) {
+	l.entry.Debug(msg)
+}
+
+// Info emits msg at info level with the accumulated field context.
+func (l *Logger) Info(msg string) {
+	l.entry.Info(msg)
+}
+
+// Warn emits msg at warn level with the accumulated field context.
+func (l *Logger) Warn(msg string) {
+	l.entry.Warn(msg)
+}
+
+// Error emits msg at error level with the accumulated field context.
+func (l *Logger) Error(msg string) {
+	l.entry.Error(msg)
+}